@@ -0,0 +1,50 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"chainguard.dev/melange/pkg/build"
+	"github.com/spf13/cobra"
+)
+
+func convertCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "convert",
+		Short: "Convert between apk package formats",
+	}
+
+	cmd.AddCommand(convertV2ToV3Cmd())
+
+	return cmd
+}
+
+func convertV2ToV3Cmd() *cobra.Command {
+	var signingKey string
+	var signingPassphrase string
+
+	cmd := &cobra.Command{
+		Use:   "v2-to-v3 <apk>",
+		Short: "Repack a v2 apk as an APKv3 (ADB) package",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return build.ConvertV2ToV3(args[0], ".", signingKey, signingPassphrase)
+		},
+	}
+
+	cmd.Flags().StringVar(&signingKey, "signing-key", "", "key to use for signing the converted package")
+	cmd.Flags().StringVar(&signingPassphrase, "signing-passphrase", "", "passphrase to unlock the signing key")
+
+	return cmd
+}
@@ -0,0 +1,54 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+
+	"chainguard.dev/melange/pkg/index"
+	"github.com/spf13/cobra"
+)
+
+func indexCmd() *cobra.Command {
+	var outDir string
+	var signingKey string
+	var signingPassphrase string
+	var repositoryAppend bool
+
+	cmd := &cobra.Command{
+		Use:     "index",
+		Short:   "Generate APKINDEX.tar.gz for a directory of built apks",
+		Long:    `index walks a directory of built apks, one subdirectory per architecture, and generates an APKINDEX.tar.gz repository index for each.`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			pub := &index.Publisher{
+				Logger:            log.New(log.Writer(), "melange (index): ", log.LstdFlags|log.Lmsgprefix),
+				OutDir:            outDir,
+				SigningKey:        signingKey,
+				SigningPassphrase: signingPassphrase,
+				Append:            repositoryAppend,
+			}
+
+			return pub.PublishAll()
+		},
+	}
+
+	cmd.Flags().StringVar(&outDir, "out-dir", "./packages", "directory containing per-architecture apk output")
+	cmd.Flags().StringVar(&signingKey, "signing-key", "", "key to use for signing the index")
+	cmd.Flags().StringVar(&signingPassphrase, "signing-passphrase", "", "passphrase to unlock the signing key")
+	cmd.Flags().BoolVar(&repositoryAppend, "repository-append", false, "merge with an existing APKINDEX rather than rewriting it")
+
+	return cmd
+}
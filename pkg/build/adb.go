@@ -0,0 +1,543 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	apkofs "chainguard.dev/apko/pkg/fs"
+	"chainguard.dev/melange/internal/sign"
+	"github.com/klauspost/compress/zstd"
+)
+
+// PackageFormat selects the on-disk layout EmitPackage produces.
+type PackageFormat string
+
+const (
+	// PackageFormatV2 is the classic concatenated sig|control|data gzip
+	// tarball layout understood by all apk-tools releases. This is the
+	// default.
+	PackageFormatV2 PackageFormat = "v2"
+
+	// PackageFormatADB is APKv3: a single ADB (Alpine Data Binary)
+	// container carrying the package manifest and file data.
+	PackageFormatADB PackageFormat = "v3"
+)
+
+// adbFileMagic is the fixed 8-byte header every ADB file begins with: the
+// ASCII string "ADB." followed by four zero bytes.
+var adbFileMagic = [8]byte{'A', 'D', 'B', '.', 0, 0, 0, 0}
+
+// adbSchemaPackage is the schema id apk-tools uses to identify an APKv3
+// package container.
+const adbSchemaPackage uint32 = 0x78337c9c
+
+// adb tag types, matching the tagged uint32/uint32/payload encoding used by
+// apk-tools' "adb" block format.
+const (
+	adbTagPackageInfo uint32 = iota + 1
+	adbTagPaths
+	adbTagData
+	adbTagSig
+)
+
+// adb path "kind" discriminants: which of Hash/Symlink, if either, trails a
+// path record. Mode only ever carries permission bits, so a reader cannot
+// tell a directory from a zero-length regular file without this.
+const (
+	adbPathKindRegular uint8 = iota
+	adbPathKindDirectory
+	adbPathKindSymlink
+)
+
+// adbPath is a single file record inside the "paths" block: its apk-tools
+// metadata plus, depending on Kind, a content hash (regular files), a
+// symlink target, or nothing at all (directories).
+type adbPath struct {
+	Name    string
+	Mode    uint32
+	UID     uint32
+	GID     uint32
+	MTime   int64
+	Size    int64
+	Kind    uint8
+	Hash    [32]byte // blake2b-256 of file contents, set for regular files only
+	Symlink string
+}
+
+// writeBlock appends a single tagged block: a uint32 tag, a uint32 length,
+// and the payload itself, padded to a 4-byte boundary as the ADB format
+// requires.
+func writeBlock(w io.Writer, tag uint32, payload []byte) error {
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], tag)
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(len(payload)))
+
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+
+	if pad := (4 - len(payload)%4) % 4; pad > 0 {
+		if _, err := w.Write(make([]byte, pad)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// encodePath serializes a single adbPath record: the length-prefixed name,
+// mode, uid, gid, mtime, size, a kind byte, then the blake2b hash for a
+// regular file, the length-prefixed symlink target for a symlink, or
+// nothing for a directory.
+func encodePath(p adbPath) []byte {
+	var buf bytes.Buffer
+
+	writeString := func(s string) {
+		var n [4]byte
+		binary.LittleEndian.PutUint32(n[:], uint32(len(s)))
+		buf.Write(n[:])
+		buf.WriteString(s)
+	}
+
+	writeString(p.Name)
+
+	var fixed [32]byte
+	binary.LittleEndian.PutUint32(fixed[0:4], p.Mode)
+	binary.LittleEndian.PutUint32(fixed[4:8], p.UID)
+	binary.LittleEndian.PutUint32(fixed[8:12], p.GID)
+	binary.LittleEndian.PutUint64(fixed[12:20], uint64(p.MTime))
+	binary.LittleEndian.PutUint64(fixed[20:28], uint64(p.Size))
+	buf.Write(fixed[:28])
+
+	buf.WriteByte(p.Kind)
+	switch p.Kind {
+	case adbPathKindSymlink:
+		writeString(p.Symlink)
+	case adbPathKindRegular:
+		buf.Write(p.Hash[:])
+	}
+
+	return buf.Bytes()
+}
+
+// emitPackageV3 serializes the package as an APKv3/ADB container: a fixed
+// file header, a packageinfo block (the same data GenerateControlData
+// renders for v2, so both formats stay in sync), a paths block describing
+// every workspace file, and a trailing data block holding the concatenated
+// file payloads the paths block references by hash. The whole container is
+// then zstd-compressed.
+func (pc *PackageContext) emitPackageV3(fsys fs.FS) error {
+	var controlBuf bytes.Buffer
+	if err := pc.GenerateControlData(&controlBuf); err != nil {
+		return fmt.Errorf("unable to process control template: %w", err)
+	}
+
+	var paths []adbPath
+	var payload bytes.Buffer
+
+	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == "." {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rec := adbPath{
+			Name:  path,
+			Mode:  uint32(fi.Mode().Perm()),
+			MTime: pc.Context.SourceDateEpoch.Unix(),
+			Size:  fi.Size(),
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			// TODO(kaniini): use fs.ReadLink once apkofs.DirFS implements it
+			target, err := os.Readlink(filepath.Join(pc.WorkspaceSubdir(), path))
+			if err != nil {
+				return fmt.Errorf("unable to read symlink %s: %w", path, err)
+			}
+			rec.Kind = adbPathKindSymlink
+			rec.Symlink = target
+			paths = append(paths, rec)
+			return nil
+		}
+
+		if d.IsDir() {
+			rec.Kind = adbPathKindDirectory
+			paths = append(paths, rec)
+			return nil
+		}
+
+		if !fi.Mode().IsRegular() {
+			paths = append(paths, rec)
+			return nil
+		}
+
+		f, err := fsys.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h, err := blake2b.New256(nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(io.MultiWriter(h, &payload), f); err != nil {
+			return fmt.Errorf("unable to hash %s: %w", path, err)
+		}
+		copy(rec.Hash[:], h.Sum(nil))
+
+		paths = append(paths, rec)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("unable to walk package contents: %w", err)
+	}
+
+	var pathsBuf bytes.Buffer
+	for _, p := range paths {
+		pathsBuf.Write(encodePath(p))
+	}
+
+	var manifest bytes.Buffer
+	if err := writeBlock(&manifest, adbTagPackageInfo, controlBuf.Bytes()); err != nil {
+		return fmt.Errorf("unable to write packageinfo block: %w", err)
+	}
+	if err := writeBlock(&manifest, adbTagPaths, pathsBuf.Bytes()); err != nil {
+		return fmt.Errorf("unable to write paths block: %w", err)
+	}
+
+	var adbBuf bytes.Buffer
+	adbBuf.Write(adbFileMagic[:])
+	var schema [4]byte
+	binary.LittleEndian.PutUint32(schema[:], adbSchemaPackage)
+	adbBuf.Write(schema[:])
+	adbBuf.Write(manifest.Bytes())
+
+	if pc.Context.SigningKey != "" {
+		sig, err := pc.signADB(adbBuf.Bytes())
+		if err != nil {
+			return fmt.Errorf("unable to sign ADB package: %w", err)
+		}
+
+		if err := writeBlock(&adbBuf, adbTagSig, sig); err != nil {
+			return fmt.Errorf("unable to write signature block: %w", err)
+		}
+	}
+
+	// the data block's payload is the concatenated file bytes themselves,
+	// so readers that honor the declared block length land exactly on the
+	// file data the paths block's hashes refer to.
+	if err := writeBlock(&adbBuf, adbTagData, payload.Bytes()); err != nil {
+		return fmt.Errorf("unable to write data block: %w", err)
+	}
+
+	if err := os.MkdirAll(pc.OutDir, 0755); err != nil {
+		return fmt.Errorf("unable to create output directory: %w", err)
+	}
+
+	outFile, err := os.Create(pc.Filename())
+	if err != nil {
+		return fmt.Errorf("unable to create apk file: %w", err)
+	}
+	defer outFile.Close()
+
+	zw, err := zstd.NewWriter(outFile)
+	if err != nil {
+		return fmt.Errorf("unable to build zstd writer: %w", err)
+	}
+
+	if _, err := zw.Write(adbBuf.Bytes()); err != nil {
+		return fmt.Errorf("unable to write ADB container: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("unable to finalize package: %w", err)
+	}
+
+	pc.Logger.Printf("wrote %s", outFile.Name())
+
+	return nil
+}
+
+// signADB produces a detached Ed25519 signature over the ADB header and
+// manifest. apk-tools' "sig" block format is an algorithm id byte followed
+// by the raw signature bytes.
+func (pc *PackageContext) signADB(manifest []byte) ([]byte, error) {
+	key, err := sign.LoadEd25519Key(pc.Context.SigningKey, pc.Context.SigningPassphrase)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load signing key: %w", err)
+	}
+
+	sig := ed25519.Sign(key, manifest)
+
+	out := make([]byte, 0, len(sig)+1)
+	out = append(out, byte(adbSigAlgoEd25519))
+	out = append(out, sig...)
+
+	return out, nil
+}
+
+// adb signature algorithm ids understood by apk-tools' "sig" block.
+const adbSigAlgoEd25519 = 1
+
+// ConvertV2ToV3 repacks the v2 apk at srcPath as an APKv3/ADB package in
+// outDir, reusing the same control data, dependency set and path/hash
+// records the v3 emitter produces for a freshly-built package.
+func ConvertV2ToV3(srcPath, outDir, signingKey, signingPassphrase string) error {
+	workDir, err := os.MkdirTemp("", "melange-convert-*")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary workspace: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	origin, deps, err := unpackV2(srcPath, workDir)
+	if err != nil {
+		return fmt.Errorf("unable to unpack %s: %w", srcPath, err)
+	}
+
+	pc := &PackageContext{
+		Context: &Context{
+			OutDir:            outDir,
+			PackageFormat:     PackageFormatADB,
+			SigningKey:        signingKey,
+			SigningPassphrase: signingPassphrase,
+			SourceDateEpoch:   time.Unix(0, 0),
+			WorkspaceDir:      workDir,
+		},
+		Origin:       origin,
+		PackageName:  origin.Name,
+		OutDir:       outDir,
+		Logger:       log.New(log.Writer(), fmt.Sprintf("melange (convert %s): ", origin.Name), log.LstdFlags|log.Lmsgprefix),
+		Dependencies: deps,
+	}
+
+	return pc.emitPackageV3(apkofs.DirFS(pc.WorkspaceSubdir()))
+}
+
+// unpackV2 extracts the data.tar.gz payload of a v2 apk into
+// workDir/melange-out/<pkgname> and returns the origin package metadata and
+// dependency set recovered from its .PKGINFO.
+func unpackV2(srcPath, workDir string) (*Package, Dependencies, error) {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return nil, Dependencies{}, err
+	}
+	defer f.Close()
+
+	// a v2 apk is a concatenation of gzip members -- an optional detached
+	// signature, the control tarball, then the data tarball -- read in
+	// order off a single shared bufio.Reader, so each gzip.NewReader call
+	// picks up exactly where the previous member left off.
+	br := bufio.NewReader(f)
+
+	var origin *Package
+	var deps Dependencies
+	var destDir string
+
+	for origin == nil || destDir == "" {
+		entries, bodies, err := readTarMember(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, Dependencies{}, err
+		}
+
+		if isSignatureMember(entries) {
+			continue
+		}
+
+		if i := indexOfName(entries, ".PKGINFO"); i >= 0 {
+			origin, deps = parsePKGINFOForConvert(bodies[i])
+			continue
+		}
+
+		if origin == nil {
+			return nil, Dependencies{}, fmt.Errorf("%s: data tarball precedes .PKGINFO", srcPath)
+		}
+
+		destDir = filepath.Join(workDir, "melange-out", origin.Name)
+		if err := writeTarEntries(destDir, entries, bodies); err != nil {
+			return nil, Dependencies{}, err
+		}
+	}
+
+	if origin == nil {
+		return nil, Dependencies{}, fmt.Errorf("%s: no .PKGINFO found", srcPath)
+	}
+	if destDir == "" {
+		return nil, Dependencies{}, fmt.Errorf("%s: no data tarball found", srcPath)
+	}
+
+	return origin, deps, nil
+}
+
+// indexOfName returns the index of the entry named name, or -1.
+func indexOfName(entries []*tar.Header, name string) int {
+	for i, hdr := range entries {
+		if hdr.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// isSignatureMember reports whether entries is a detached signature tarball,
+// i.e. emitPackageV2's signing step, rather than the control or data
+// tarball. Its single entry is always named ".SIGN.<algo>.<keyname>.pub".
+func isSignatureMember(entries []*tar.Header) bool {
+	return len(entries) == 1 && strings.HasPrefix(entries[0].Name, ".SIGN.")
+}
+
+// readTarMember reads the next gzip-compressed tar member from br, starting
+// at its current offset, fully into memory. br must be shared across
+// successive calls: gzip.NewReader reads ahead through the flate.Reader
+// interface br already satisfies, so the next member starts exactly where
+// this one left off instead of losing bytes to a fresh internal buffer.
+func readTarMember(br *bufio.Reader) ([]*tar.Header, [][]byte, error) {
+	gzr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	gzr.Multistream(false)
+	defer gzr.Close()
+
+	var entries []*tar.Header
+	var bodies [][]byte
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, tr); err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, hdr)
+		bodies = append(bodies, buf.Bytes())
+	}
+
+	return entries, bodies, nil
+}
+
+// writeTarEntries recreates a tarball's entries on disk under destDir.
+func writeTarEntries(destDir string, entries []*tar.Header, bodies [][]byte) error {
+	for i, hdr := range entries {
+		dest := filepath.Join(destDir, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, dest); err != nil {
+				return err
+			}
+		default:
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(dest, bodies[i], os.FileMode(hdr.Mode)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// parsePKGINFOForConvert decodes a .PKGINFO blob into the minimal Package
+// and Dependencies needed to re-emit the package.
+func parsePKGINFOForConvert(data []byte) (*Package, Dependencies) {
+	origin := &Package{}
+	deps := Dependencies{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		switch key {
+		case "pkgname":
+			origin.Name = value
+		case "pkgver":
+			version, epoch, ok := cutEpoch(value)
+			origin.Version = version
+			if ok {
+				fmt.Sscanf(epoch, "%d", &origin.Epoch)
+			}
+		case "pkgdesc":
+			origin.Description = value
+		case "license":
+			origin.Copyright = append(origin.Copyright, Copyright{License: value})
+		case "depend":
+			deps.Runtime = append(deps.Runtime, value)
+		case "provides":
+			deps.Provides = append(deps.Provides, value)
+		}
+	}
+
+	return origin, deps
+}
+
+// pkgverEpochRE matches the "-r<digits>" epoch suffix apk-tools appends to
+// the end of a pkgver, e.g. the "-r0" in "1.2.3-rc1-r0". Anchored at the end
+// so a version containing its own "-r" substring, such as "-rc1", isn't
+// mistaken for the epoch separator.
+var pkgverEpochRE = regexp.MustCompile(`-r(\d+)$`)
+
+// cutEpoch splits value into its version and trailing "-r<digits>" epoch, if
+// any, mirroring strings.Cut's (before, after, found) result shape.
+func cutEpoch(value string) (version, epoch string, found bool) {
+	loc := pkgverEpochRE.FindStringSubmatchIndex(value)
+	if loc == nil {
+		return value, "", false
+	}
+	return value[:loc[0]], value[loc[2]:loc[3]], true
+}
@@ -0,0 +1,222 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	apkofs "chainguard.dev/apko/pkg/fs"
+	"github.com/klauspost/compress/zstd"
+)
+
+// adbBlock is a single decoded tagged block, for test assertions only.
+type adbBlock struct {
+	tag     uint32
+	payload []byte
+}
+
+// readADBBlocks decodes the header and every tagged block out of a raw
+// (already zstd-decompressed) ADB container.
+func readADBBlocks(t *testing.T, raw []byte) []adbBlock {
+	t.Helper()
+
+	if len(raw) < 12 || string(raw[:3]) != "ADB" {
+		t.Fatalf("missing ADB file magic, got %x", raw[:min(len(raw), 8)])
+	}
+	if schema := binary.LittleEndian.Uint32(raw[8:12]); schema != adbSchemaPackage {
+		t.Fatalf("schema = %#x, want %#x", schema, adbSchemaPackage)
+	}
+
+	var blocks []adbBlock
+	for off := 12; off < len(raw); {
+		tag := binary.LittleEndian.Uint32(raw[off : off+4])
+		length := binary.LittleEndian.Uint32(raw[off+4 : off+8])
+		off += 8
+
+		blocks = append(blocks, adbBlock{tag: tag, payload: raw[off : off+int(length)]})
+		off += int(length)
+		if pad := (4 - int(length)%4) % 4; pad > 0 {
+			off += pad
+		}
+	}
+
+	return blocks
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// decodedPath is a single decoded "paths" block record, for test assertions
+// only.
+type decodedPath struct {
+	name string
+	mode uint32
+	kind uint8
+	hash [32]byte
+}
+
+// decodePaths decodes every adbPath record out of a "paths" block payload,
+// mirroring encodePath's layout: a length-prefixed name, 28 fixed metadata
+// bytes, a kind byte, then whatever trails it for that kind.
+func decodePaths(t *testing.T, payload []byte) []decodedPath {
+	t.Helper()
+
+	var out []decodedPath
+	for off := 0; off < len(payload); {
+		nameLen := int(binary.LittleEndian.Uint32(payload[off : off+4]))
+		off += 4
+		name := string(payload[off : off+nameLen])
+		off += nameLen
+
+		dp := decodedPath{name: name, mode: binary.LittleEndian.Uint32(payload[off : off+4])}
+		off += 28 // mode, uid, gid, mtime, size
+
+		dp.kind = payload[off]
+		off++
+
+		switch dp.kind {
+		case adbPathKindRegular:
+			copy(dp.hash[:], payload[off:off+32])
+			off += 32
+		case adbPathKindSymlink:
+			targetLen := int(binary.LittleEndian.Uint32(payload[off : off+4]))
+			off += 4 + targetLen
+		}
+
+		out = append(out, dp)
+	}
+
+	return out
+}
+
+// TestEmitPackageV3DataBlockRoundTrip builds a tiny workspace with a nested
+// directory, emits it as an ADB/v3 package, and checks both that the data
+// block actually carries the file payload the paths block's hashes refer to
+// (rather than an empty block with the bytes written outside its length
+// framing) and that the directory is recorded with its own kind and mode
+// rather than being indistinguishable from a zero-byte regular file.
+func TestEmitPackageV3DataBlockRoundTrip(t *testing.T) {
+	workDir := t.TempDir()
+	outDir := t.TempDir()
+
+	subdir := filepath.Join(workDir, "melange-out", "foo")
+	if err := os.MkdirAll(filepath.Join(subdir, "usr"), 0755); err != nil {
+		t.Fatalf("unable to create workspace dir: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(subdir, "usr/bin"), 0750); err != nil {
+		t.Fatalf("unable to create usr/bin: %v", err)
+	}
+
+	contents := []byte("#!/bin/sh\necho foo\n")
+	if err := os.WriteFile(filepath.Join(subdir, "usr/bin/foo"), contents, 0644); err != nil {
+		t.Fatalf("unable to write workspace file: %v", err)
+	}
+
+	pc := &PackageContext{
+		Context: &Context{
+			OutDir:          outDir,
+			PackageFormat:   PackageFormatADB,
+			SourceDateEpoch: time.Unix(0, 0),
+			WorkspaceDir:    workDir,
+		},
+		Origin:      &Package{Name: "foo", Version: "1.0", Description: "a test package"},
+		PackageName: "foo",
+		OutDir:      outDir,
+		Logger:      log.New(io.Discard, "", 0),
+	}
+
+	if err := pc.emitPackageV3(apkofs.DirFS(subdir)); err != nil {
+		t.Fatalf("emitPackageV3() = %v", err)
+	}
+
+	raw, err := os.ReadFile(pc.Filename())
+	if err != nil {
+		t.Fatalf("unable to read emitted apk: %v", err)
+	}
+
+	zr, err := zstd.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("zstd.NewReader() = %v", err)
+	}
+	defer zr.Close()
+
+	decoded, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("unable to decompress apk: %v", err)
+	}
+
+	var dataBlock []byte
+	var paths []decodedPath
+	for _, b := range readADBBlocks(t, decoded) {
+		switch b.tag {
+		case adbTagData:
+			dataBlock = b.payload
+		case adbTagPaths:
+			paths = decodePaths(t, b.payload)
+		}
+	}
+	if paths == nil {
+		t.Fatalf("no paths block found")
+	}
+
+	if !bytes.Equal(dataBlock, contents) {
+		t.Errorf("data block = %q, want %q (file payload must be the block's own content, not appended after it)", dataBlock, contents)
+	}
+
+	byName := map[string]decodedPath{}
+	for _, p := range paths {
+		byName[p.name] = p
+	}
+
+	dir, ok := byName["usr/bin"]
+	if !ok {
+		t.Fatalf("expected usr/bin directory entry, got %+v", paths)
+	}
+	if dir.kind != adbPathKindDirectory {
+		t.Errorf("usr/bin kind = %d, want adbPathKindDirectory (%d)", dir.kind, adbPathKindDirectory)
+	}
+	if dir.mode != 0750 {
+		t.Errorf("usr/bin mode = %o, want 0750", dir.mode)
+	}
+
+	file, ok := byName["usr/bin/foo"]
+	if !ok {
+		t.Fatalf("expected usr/bin/foo file entry, got %+v", paths)
+	}
+	if file.kind != adbPathKindRegular {
+		t.Errorf("usr/bin/foo kind = %d, want adbPathKindRegular (%d)", file.kind, adbPathKindRegular)
+	}
+	if file.mode != 0644 {
+		t.Errorf("usr/bin/foo mode = %o, want 0644", file.mode)
+	}
+
+	sum := blake2b.Sum256(contents)
+	if file.hash != sum {
+		t.Errorf("usr/bin/foo hash = %x, want %x", file.hash, sum)
+	}
+}
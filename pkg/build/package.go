@@ -18,7 +18,6 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"crypto/sha256"
-	"debug/elf"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -33,6 +32,7 @@ import (
 	apkofs "chainguard.dev/apko/pkg/fs"
 	"chainguard.dev/apko/pkg/tarball"
 	"chainguard.dev/melange/internal/sign"
+	"chainguard.dev/melange/pkg/contenthash"
 	"github.com/psanford/memfs"
 )
 
@@ -45,12 +45,39 @@ type PackageContext struct {
 	OutDir        string
 	Logger        *log.Logger
 	Dependencies  Dependencies
+	Scripts       Scripts
+	Triggers      Trigger
+
+	cache *contenthash.CacheContext
+}
+
+// ContentCache returns (lazily creating) the content digest cache for this
+// package's workspace subdirectory, so that dependency scanning and the
+// data-tarball walk can skip re-hashing and re-scanning files that have not
+// changed since the last build.
+func (pc *PackageContext) ContentCache() (*contenthash.CacheContext, error) {
+	if pc.cache != nil {
+		return pc.cache, nil
+	}
+
+	dir := pc.WorkspaceSubdir()
+	id := strings.ReplaceAll(strings.TrimPrefix(dir, string(filepath.Separator)), string(filepath.Separator), "_")
+
+	cc, err := contenthash.New(dir, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open content cache: %w", err)
+	}
+
+	pc.cache = cc
+	return cc, nil
 }
 
 func (pkg *Package) Emit(ctx *PipelineContext) error {
 	fakesp := Subpackage{
 		Name:         pkg.Name,
 		Dependencies: pkg.Dependencies,
+		Scripts:      pkg.Scripts,
+		Triggers:     pkg.Triggers,
 	}
 	return fakesp.Emit(ctx)
 }
@@ -63,6 +90,8 @@ func (spkg *Subpackage) Emit(ctx *PipelineContext) error {
 		OutDir:       filepath.Join(ctx.Context.OutDir, ctx.Context.Arch.ToAPK()),
 		Logger:       log.New(log.Writer(), fmt.Sprintf("melange (%s/%s): ", spkg.Name, ctx.Context.Arch.ToAPK()), log.LstdFlags|log.Lmsgprefix),
 		Dependencies: spkg.Dependencies,
+		Scripts:      spkg.Scripts,
+		Triggers:     spkg.Triggers,
 	}
 	return pc.EmitPackage()
 }
@@ -95,6 +124,9 @@ depend = {{ $dep }}
 {{- range $dep := .Dependencies.Provides }}
 provides = {{ $dep }}
 {{- end }}
+{{- with .TriggerLine }}
+{{.}}
+{{- end }}
 datahash = {{.DataHash}}
 `
 
@@ -162,6 +194,11 @@ func generateCmdProviders(pc *PackageContext, generated *Dependencies) error {
 func generateSharedObjectNameDeps(pc *PackageContext, generated *Dependencies) error {
 	pc.Logger.Printf("scanning for shared object dependencies...")
 
+	cache, err := pc.ContentCache()
+	if err != nil {
+		return err
+	}
+
 	fsys := apkofs.DirFS(pc.WorkspaceSubdir())
 	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
@@ -194,18 +231,15 @@ func generateSharedObjectNameDeps(pc *PackageContext, generated *Dependencies) e
 				generated.Provides = append(generated.Provides, fmt.Sprintf("so:%s=%s", basename, libver))
 			}
 
-			// most likely a shell script instead of an ELF, so treat any
-			// error as non-fatal.
-			// TODO(kaniini): use DirFS for this
-			ef, err := elf.Open(filepath.Join(pc.WorkspaceSubdir(), path))
+			// the cache memoizes the debug/elf scan by (mtime, size, mode),
+			// so unchanged binaries aren't re-opened on every build. A
+			// non-ELF file (most likely a shell script) comes back with
+			// isELF false; a lookup error is treated as non-fatal too.
+			isELF, libs, _, err := cache.ELFInfo(path)
 			if err != nil {
 				return nil
 			}
-			defer ef.Close()
-
-			libs, err := ef.ImportedLibraries()
-			if err != nil {
-				pc.Logger.Printf("WTF: ImportedLibraries() returned error: %v", err)
+			if !isELF {
 				return nil
 			}
 
@@ -219,7 +253,7 @@ func generateSharedObjectNameDeps(pc *PackageContext, generated *Dependencies) e
 		return err
 	}
 
-	return nil
+	return pc.cache.Save()
 }
 
 func (dep *Dependencies) Summarize(logger *log.Logger) {
@@ -274,25 +308,16 @@ func combine(out io.Writer, inputs ...io.Reader) error {
 	return nil
 }
 
-// TODO(kaniini): generate APKv3 packages
+// EmitPackage performs the steps common to both package formats -- sizing
+// and hashing the workspace, generating dependencies, and embedding the SBOM
+// -- then dispatches to the format-specific serializer selected by
+// pc.Context.PackageFormat.
 func (pc *PackageContext) EmitPackage() error {
 	pc.Logger.Printf("generating package %s", pc.Identity())
 
-	dataTarGz, err := os.CreateTemp("", "melange-data-*.tar.gz")
-	if err != nil {
-		return fmt.Errorf("unable to open temporary file for writing: %w", err)
-	}
-	defer dataTarGz.Close()
-
-	tarctx, err := tarball.NewContext(
-		tarball.WithSourceDateEpoch(pc.Context.SourceDateEpoch),
-		tarball.WithOverrideUIDGID(0, 0),
-		tarball.WithOverrideUname("root"),
-		tarball.WithOverrideGname("root"),
-		tarball.WithUseChecksums(true),
-	)
+	cache, err := pc.ContentCache()
 	if err != nil {
-		return fmt.Errorf("unable to build tarball context: %w", err)
+		return err
 	}
 
 	fsys := apkofs.DirFS(pc.WorkspaceSubdir())
@@ -301,12 +326,15 @@ func (pc *PackageContext) EmitPackage() error {
 			return err
 		}
 
-		fi, err := d.Info()
+		// go through the content cache, not a raw Lstat, so this pass
+		// populates the same per-path nodes generateSharedObjectNameDeps's
+		// ELFInfo lookups reuse further down in EmitPackage.
+		size, err := cache.Size(path)
 		if err != nil {
 			return err
 		}
 
-		pc.InstalledSize += fi.Size()
+		pc.InstalledSize += size
 		return nil
 	}); err != nil {
 		return fmt.Errorf("unable to preprocess package data: %w", err)
@@ -317,6 +345,42 @@ func (pc *PackageContext) EmitPackage() error {
 		return fmt.Errorf("unable to build final dependencies set: %w", err)
 	}
 
+	// Embed an SPDX SBOM describing the package contents. There is no
+	// --sbom=false opt-out yet: no command in cmd/melange drives EmitPackage
+	// (that's melange's own `build` command, not part of this tree), so a
+	// flag here would have nothing to plumb it to. Add one, and the
+	// PackageContext field it sets, once that command is reachable here.
+	if err := pc.embedSBOM(fsys); err != nil {
+		return fmt.Errorf("unable to embed SBOM: %w", err)
+	}
+
+	if pc.Context.PackageFormat == PackageFormatADB {
+		return pc.emitPackageV3(fsys)
+	}
+
+	return pc.emitPackageV2(fsys)
+}
+
+// emitPackageV2 writes the classic concatenated sig|control|data gzip
+// tarball format (APKv2).
+func (pc *PackageContext) emitPackageV2(fsys fs.FS) error {
+	dataTarGz, err := os.CreateTemp("", "melange-data-*.tar.gz")
+	if err != nil {
+		return fmt.Errorf("unable to open temporary file for writing: %w", err)
+	}
+	defer dataTarGz.Close()
+
+	tarctx, err := tarball.NewContext(
+		tarball.WithSourceDateEpoch(pc.Context.SourceDateEpoch),
+		tarball.WithOverrideUIDGID(0, 0),
+		tarball.WithOverrideUname("root"),
+		tarball.WithOverrideGname("root"),
+		tarball.WithUseChecksums(true),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to build tarball context: %w", err)
+	}
+
 	// prepare data.tar.gz
 	dataDigest := sha256.New()
 	dataMW := io.MultiWriter(dataDigest, dataTarGz)
@@ -354,6 +418,10 @@ func (pc *PackageContext) EmitPackage() error {
 		return fmt.Errorf("unable to build control FS: %w", err)
 	}
 
+	if err := pc.WriteScripts(controlFS); err != nil {
+		return fmt.Errorf("unable to write scripts: %w", err)
+	}
+
 	controlTarGz, err := os.CreateTemp("", "melange-control-*.tar.gz")
 	if err != nil {
 		return fmt.Errorf("unable to open temporary file for writing: %w", err)
@@ -0,0 +1,188 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"crypto/sha1" // nolint:gosec
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	spdx_json "github.com/spdx/tools-golang/json"
+	"github.com/spdx/tools-golang/spdx/v2/common"
+	"github.com/spdx/tools-golang/spdx/v2/v2_3"
+)
+
+// sbomPath is where the generated SPDX document is embedded inside the
+// package itself, relative to the workspace root.
+func (pc *PackageContext) sbomPath() string {
+	return fmt.Sprintf("usr/share/spdx/%s.spdx.json", pc.PackageName)
+}
+
+// licenseDeclared joins the copyright declarations on the origin package
+// into a single SPDX license expression, defaulting to NOASSERTION.
+func (pc *PackageContext) licenseDeclared() string {
+	var licenses []string
+	for _, c := range pc.Origin.Copyright {
+		if c.License != "" {
+			licenses = append(licenses, c.License)
+		}
+	}
+
+	if len(licenses) == 0 {
+		return "NOASSERTION"
+	}
+
+	return strings.Join(licenses, " AND ")
+}
+
+// GenerateSBOM walks fsys and builds an SPDX 2.3 document describing every
+// regular file as a File element, HAS_FILE'd from a single top-level Package
+// element representing pc.Identity(). Runtime so: dependencies already
+// resolved onto pc.Dependencies become DEPENDS_ON relationships.
+func (pc *PackageContext) GenerateSBOM(fsys fs.FS) (*v2_3.Document, error) {
+	pc.Logger.Printf("generating SBOM")
+
+	pkgID := "Package-" + pc.PackageName
+	license := pc.licenseDeclared()
+
+	doc := &v2_3.Document{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXIdentifier:    "DOCUMENT",
+		DocumentName:      pc.Identity(),
+		DocumentNamespace: fmt.Sprintf("https://spdx.org/spdxdocs/melange/%s", pc.Identity()),
+		Packages: []*v2_3.Package{
+			{
+				PackageSPDXIdentifier:   v2_3.ElementID(pkgID),
+				PackageName:             pc.PackageName,
+				PackageVersion:          fmt.Sprintf("%s-r%d", pc.Origin.Version, pc.Origin.Epoch),
+				PackageDescription:      pc.Origin.Description,
+				PackageLicenseDeclared:  license,
+				PackageLicenseConcluded: license,
+				PackageDownloadLocation: "NOASSERTION",
+			},
+		},
+	}
+
+	var files []*v2_3.File
+	var relationships []*v2_3.Relationship
+
+	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := fsys.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		sha256sum := sha256.New()
+		sha1sum := sha1.New() // nolint:gosec
+		if _, err := io.Copy(io.MultiWriter(sha256sum, sha1sum), f); err != nil {
+			return fmt.Errorf("unable to hash %s: %w", path, err)
+		}
+
+		fileID := v2_3.ElementID(fmt.Sprintf("File-%s", strings.ReplaceAll(path, "/", "-")))
+		files = append(files, &v2_3.File{
+			FileSPDXIdentifier: fileID,
+			FileName:           "/" + path,
+			Checksums: []common.Checksum{
+				{Algorithm: common.SHA256, Value: hex.EncodeToString(sha256sum.Sum(nil))},
+				{Algorithm: common.SHA1, Value: hex.EncodeToString(sha1sum.Sum(nil))},
+			},
+			LicenseConcluded: license,
+		})
+
+		relationships = append(relationships, &v2_3.Relationship{
+			RefA:         v2_3.DocElementID{ElementRefID: v2_3.ElementID(pkgID)},
+			RefB:         v2_3.DocElementID{ElementRefID: fileID},
+			Relationship: "HAS_FILE",
+		})
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("unable to walk package contents: %w", err)
+	}
+
+	doc.Files = files
+
+	for _, dep := range pc.Dependencies.Runtime {
+		if !strings.HasPrefix(dep, "so:") {
+			continue
+		}
+
+		depID := v2_3.ElementID(fmt.Sprintf("SharedObject-%s", strings.TrimPrefix(dep, "so:")))
+		relationships = append(relationships, &v2_3.Relationship{
+			RefA:         v2_3.DocElementID{ElementRefID: v2_3.ElementID(pkgID)},
+			RefB:         v2_3.DocElementID{ElementRefID: depID},
+			Relationship: "DEPENDS_ON",
+		})
+	}
+
+	doc.Relationships = relationships
+
+	return doc, nil
+}
+
+// WriteSBOM marshals the SBOM for fsys as SPDX JSON.
+func (pc *PackageContext) WriteSBOM(fsys fs.FS, w io.Writer) error {
+	doc, err := pc.GenerateSBOM(fsys)
+	if err != nil {
+		return err
+	}
+
+	return spdx_json.Save2_3(doc, w)
+}
+
+// embedSBOM generates the SBOM for fsys and writes it into the workspace at
+// sbomPath, so it ships inside the package's own data.tar.gz. InstalledSize
+// is updated to account for the new file before data.tar.gz is written.
+func (pc *PackageContext) embedSBOM(fsys fs.FS) error {
+	var buf bytes.Buffer
+	if err := pc.WriteSBOM(fsys, &buf); err != nil {
+		return fmt.Errorf("unable to generate SBOM: %w", err)
+	}
+
+	dest := filepath.Join(pc.WorkspaceSubdir(), pc.sbomPath())
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("unable to create SBOM directory: %w", err)
+	}
+
+	if err := os.WriteFile(dest, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("unable to write SBOM: %w", err)
+	}
+
+	pc.InstalledSize += int64(buf.Len())
+
+	return nil
+}
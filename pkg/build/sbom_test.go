@@ -0,0 +1,89 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	spdx_json "github.com/spdx/tools-golang/json"
+)
+
+// TestGenerateSBOMListsEveryFile walks a small fake workspace, generates its
+// SBOM, parses the result back with spdx/tools-golang, and checks that
+// every walked file appears exactly once and that a so: runtime dependency
+// is reflected as a DEPENDS_ON relationship.
+func TestGenerateSBOMListsEveryFile(t *testing.T) {
+	dir := t.TempDir()
+
+	files := []string{"usr/bin/foo", "usr/lib/libfoo.so.1", "etc/foo.conf"}
+	for _, f := range files {
+		full := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("unable to create dir for %s: %v", f, err)
+		}
+		if err := os.WriteFile(full, []byte("contents of "+f), 0644); err != nil {
+			t.Fatalf("unable to write %s: %v", f, err)
+		}
+	}
+
+	pc := &PackageContext{
+		PackageName: "foo",
+		Origin: &Package{
+			Name:        "foo",
+			Version:     "1.0",
+			Description: "a test package",
+			Copyright:   []Copyright{{License: "MIT"}},
+		},
+		Dependencies: Dependencies{Runtime: []string{"so:libbar.so.1"}},
+		Logger:       log.New(io.Discard, "", 0),
+	}
+
+	var buf bytes.Buffer
+	if err := pc.WriteSBOM(os.DirFS(dir), &buf); err != nil {
+		t.Fatalf("WriteSBOM() = %v", err)
+	}
+
+	doc, err := spdx_json.Load2_3(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("unable to parse SBOM: %v (document:\n%s)", err, buf.String())
+	}
+
+	seen := map[string]int{}
+	for _, f := range doc.Files {
+		seen[f.FileName]++
+	}
+
+	for _, f := range files {
+		name := "/" + f
+		if seen[name] != 1 {
+			t.Errorf("file %s appears %d times in SBOM, want 1", name, seen[name])
+		}
+	}
+
+	var dependsOn bool
+	for _, rel := range doc.Relationships {
+		if rel.Relationship == "DEPENDS_ON" {
+			dependsOn = true
+		}
+	}
+	if !dependsOn {
+		t.Errorf("expected a DEPENDS_ON relationship for the so: runtime dependency")
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/psanford/memfs"
+)
+
+// Scripts holds the APK scriptlets that apk-tools runs around the
+// install/upgrade/removal lifecycle of a package. Each scriptlet field may
+// be either an inline shell script or a path to a script file relative to
+// the build source directory.
+type Scripts struct {
+	PreInstall    string `yaml:"preInstall,omitempty"`
+	PostInstall   string `yaml:"postInstall,omitempty"`
+	PreDeinstall  string `yaml:"preDeinstall,omitempty"`
+	PostDeinstall string `yaml:"postDeinstall,omitempty"`
+	PreUpgrade    string `yaml:"preUpgrade,omitempty"`
+	PostUpgrade   string `yaml:"postUpgrade,omitempty"`
+}
+
+// Trigger describes an APK trigger scriptlet. apk-tools runs Script whenever
+// a transaction touches a path matching one of Paths.
+type Trigger struct {
+	// Paths is a list of glob patterns watched by apk-tools.
+	Paths []string `yaml:"paths,omitempty"`
+	// Script is the trigger scriptlet itself, inline or a path to a file.
+	Script string `yaml:"script,omitempty"`
+}
+
+// scriptletFilenames maps each scriptlet slot to the fixed filename
+// apk-tools expects to find it under inside control.tar.gz.
+var scriptletFilenames = map[string]string{
+	"pre-install":    ".pre-install",
+	"post-install":   ".post-install",
+	"pre-deinstall":  ".pre-deinstall",
+	"post-deinstall": ".post-deinstall",
+	"pre-upgrade":    ".pre-upgrade",
+	"post-upgrade":   ".post-upgrade",
+}
+
+// resolveScript returns the contents of a scriptlet. If script names a file
+// under the source directory it is read from disk; otherwise it is treated
+// as an inline script body.
+func (pc *PackageContext) resolveScript(script string) ([]byte, error) {
+	candidate := filepath.Join(pc.Context.SourceDir, script)
+	if fi, err := os.Stat(candidate); err == nil && !fi.IsDir() {
+		return os.ReadFile(candidate)
+	}
+
+	return []byte(script), nil
+}
+
+// WriteScripts adds any configured install/upgrade/removal scriptlets and
+// trigger to the control filesystem, using the fixed names and 0755 mode
+// apk-tools expects inside control.tar.gz.
+func (pc *PackageContext) WriteScripts(controlFS *memfs.FS) error {
+	scripts := map[string]string{
+		"pre-install":    pc.Scripts.PreInstall,
+		"post-install":   pc.Scripts.PostInstall,
+		"pre-deinstall":  pc.Scripts.PreDeinstall,
+		"post-deinstall": pc.Scripts.PostDeinstall,
+		"pre-upgrade":    pc.Scripts.PreUpgrade,
+		"post-upgrade":   pc.Scripts.PostUpgrade,
+	}
+
+	for slot, script := range scripts {
+		if script == "" {
+			continue
+		}
+
+		data, err := pc.resolveScript(script)
+		if err != nil {
+			return fmt.Errorf("unable to read %s script: %w", slot, err)
+		}
+
+		if err := controlFS.WriteFile(scriptletFilenames[slot], data, 0755); err != nil {
+			return fmt.Errorf("unable to write %s script: %w", slot, err)
+		}
+	}
+
+	if len(pc.Triggers.Paths) == 0 {
+		return nil
+	}
+
+	data, err := pc.resolveScript(pc.Triggers.Script)
+	if err != nil {
+		return fmt.Errorf("unable to read trigger script: %w", err)
+	}
+
+	if err := controlFS.WriteFile(".trigger", data, 0755); err != nil {
+		return fmt.Errorf("unable to write trigger script: %w", err)
+	}
+
+	return nil
+}
+
+// TriggerLine renders the PKGINFO "triggers" line for the configured
+// trigger, or the empty string if no trigger is configured.
+func (pc *PackageContext) TriggerLine() string {
+	if len(pc.Triggers.Paths) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("triggers = %s", strings.Join(pc.Triggers.Paths, " "))
+}
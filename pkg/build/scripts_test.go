@@ -0,0 +1,105 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"chainguard.dev/apko/pkg/tarball"
+	"github.com/psanford/memfs"
+)
+
+// TestWriteScriptsRoundTrip builds a control filesystem with every scriptlet
+// and a trigger configured, then round-trips it through the same tar+gzip
+// encoding `tar tzvf` would read, verifying names and modes survive.
+func TestWriteScriptsRoundTrip(t *testing.T) {
+	pc := &PackageContext{
+		Context: &Context{},
+		Scripts: Scripts{
+			PreInstall:    "#!/bin/sh\necho pre-install\n",
+			PostInstall:   "#!/bin/sh\necho post-install\n",
+			PreDeinstall:  "#!/bin/sh\necho pre-deinstall\n",
+			PostDeinstall: "#!/bin/sh\necho post-deinstall\n",
+			PreUpgrade:    "#!/bin/sh\necho pre-upgrade\n",
+			PostUpgrade:   "#!/bin/sh\necho post-upgrade\n",
+		},
+		Triggers: Trigger{
+			Paths:  []string{"/usr/share/foo/*"},
+			Script: "#!/bin/sh\necho triggered\n",
+		},
+	}
+
+	controlFS := memfs.New()
+	if err := controlFS.WriteFile(".PKGINFO", []byte("pkgname = foo\n"), 0644); err != nil {
+		t.Fatalf("unable to seed control FS: %v", err)
+	}
+
+	if err := pc.WriteScripts(controlFS); err != nil {
+		t.Fatalf("WriteScripts() = %v", err)
+	}
+
+	tarctx, err := tarball.NewContext(tarball.WithSkipClose(true))
+	if err != nil {
+		t.Fatalf("unable to build tarball context: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tarctx.WriteArchive(&buf, controlFS); err != nil {
+		t.Fatalf("WriteArchive() = %v", err)
+	}
+
+	gzr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("gzip.NewReader() = %v", err)
+	}
+	defer gzr.Close()
+
+	modes := map[string]int64{}
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar.Next() = %v", err)
+		}
+		modes[hdr.Name] = hdr.Mode
+	}
+
+	for _, name := range []string{
+		".pre-install", ".post-install",
+		".pre-deinstall", ".post-deinstall",
+		".pre-upgrade", ".post-upgrade",
+		".trigger",
+	} {
+		mode, ok := modes[name]
+		if !ok {
+			t.Errorf("expected %s in control tarball, got %v", name, modes)
+			continue
+		}
+		if mode&0755 != 0755 {
+			t.Errorf("%s: mode = %o, want 0755", name, mode)
+		}
+	}
+
+	if got, want := pc.TriggerLine(), "triggers = /usr/share/foo/*"; got != want {
+		t.Errorf("TriggerLine() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,354 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package contenthash maintains an on-disk cache of content digests for a
+// workspace, modelled on buildkit's checksum cache. The digests are kept in
+// a flat map keyed by workspace-relative path, not in a radix tree. It lets repeated builds of the same workspace skip re-hashing and
+// re-scanning (ELF import lookups, in particular) files that have not
+// changed since the last build.
+package contenthash
+
+import (
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// node is the cached record for a single path. Directories carry both a
+// header digest (its own metadata) and a recursive digest (folded in the
+// digests of everything beneath it); files carry their content digest plus
+// memoized ELF scan results.
+type node struct {
+	ModTime time.Time   `json:"mtime"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+
+	// HeaderDigest is the digest of this node's own metadata (name, mode,
+	// size; mtime is not included). ContentsDigest additionally folds in every descendant's
+	// HeaderDigest and ContentsDigest, so a change anywhere under a
+	// directory changes that directory's ContentsDigest.
+	HeaderDigest   string `json:"header"`
+	ContentsDigest string `json:"contents"`
+
+	// SHA256 is the content digest of a regular file. Unset for
+	// directories and symlinks.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// ELF scan results, cached so unchanged binaries are not re-opened with
+	// debug/elf on every build.
+	IsELF             bool     `json:"is_elf,omitempty"`
+	ImportedLibraries []string `json:"imported_libraries,omitempty"`
+	Soname            string   `json:"soname,omitempty"`
+}
+
+// matches reports whether fi describes the same (mtime, size, mode) tuple
+// this node was computed from, i.e. whether the cached digests are still
+// valid without rescanning the file.
+func (n *node) matches(fi os.FileInfo) bool {
+	return n != nil &&
+		n.ModTime.Equal(fi.ModTime()) &&
+		n.Size == fi.Size() &&
+		n.Mode == fi.Mode()
+}
+
+// CacheContext holds the persisted digest tree for a single workspace.
+type CacheContext struct {
+	mu    sync.Mutex
+	root  string // the workspace root this tree was built against
+	path  string // on-disk location of the persisted tree
+	nodes map[string]*node
+}
+
+// cacheDir returns ~/.cache/melange/contenthash, creating it if necessary.
+func cacheDir() (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to determine cache directory: %w", err)
+	}
+
+	dir := filepath.Join(base, "melange", "contenthash")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("unable to create cache directory: %w", err)
+	}
+
+	return dir, nil
+}
+
+// New loads (or initializes) the persisted digest tree for the workspace
+// rooted at root, identified by workspaceID.
+func New(root, workspaceID string) (*CacheContext, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &CacheContext{
+		root:  root,
+		path:  filepath.Join(dir, workspaceID+".json"),
+		nodes: map[string]*node{},
+	}
+
+	f, err := os.Open(cc.path)
+	if os.IsNotExist(err) {
+		return cc, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to open content cache: %w", err)
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&cc.nodes); err != nil {
+		return nil, fmt.Errorf("unable to decode content cache: %w", err)
+	}
+
+	return cc, nil
+}
+
+// Save persists the digest tree back to disk.
+func (cc *CacheContext) Save() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	tmp := cc.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("unable to write content cache: %w", err)
+	}
+
+	if err := json.NewEncoder(f).Encode(cc.nodes); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to encode content cache: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to write content cache: %w", err)
+	}
+
+	return os.Rename(tmp, cc.path)
+}
+
+// scopedPath cleans subpath and resolves it lexically against cc.root,
+// rejecting any ".." component that would escape the root -- the same rule
+// buildkit's cache applies to paths it is asked to checksum.
+func (cc *CacheContext) scopedPath(subpath string) (string, error) {
+	abs := filepath.Join(cc.root, subpath)
+
+	rel, err := filepath.Rel(cc.root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q escapes workspace root", subpath)
+	}
+
+	return abs, nil
+}
+
+// Checksum returns the recursive contents digest for subpath, reusing the
+// cached value when the underlying file (or, for a directory, everything
+// beneath it) has not changed since it was last computed.
+func (cc *CacheContext) Checksum(subpath string) (string, error) {
+	abs, err := cc.scopedPath(subpath)
+	if err != nil {
+		return "", err
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	n, err := cc.resolve(abs)
+	if err != nil {
+		return "", err
+	}
+
+	return n.ContentsDigest, nil
+}
+
+// ELFInfo returns the cached ImportedLibraries/soname scan for subpath,
+// reusing the cached result when the file is unchanged and re-scanning it
+// with debug/elf otherwise.
+func (cc *CacheContext) ELFInfo(subpath string) (isELF bool, importedLibraries []string, soname string, err error) {
+	abs, err := cc.scopedPath(subpath)
+	if err != nil {
+		return false, nil, "", err
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	n, err := cc.resolve(abs)
+	if err != nil {
+		return false, nil, "", err
+	}
+
+	return n.IsELF, n.ImportedLibraries, n.Soname, nil
+}
+
+// Size returns the cached file size for subpath, resolving (and caching) its
+// node if it is not already known. Walks that only need sizes -- such as an
+// InstalledSize tally -- go through this instead of a raw os.Lstat so they
+// populate the same cache entries a later ELFInfo or Checksum call for the
+// same path can reuse.
+func (cc *CacheContext) Size(subpath string) (int64, error) {
+	abs, err := cc.scopedPath(subpath)
+	if err != nil {
+		return 0, err
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	n, err := cc.resolve(abs)
+	if err != nil {
+		return 0, err
+	}
+
+	return n.Size, nil
+}
+
+// resolve must be called with cc.mu held. It returns the up-to-date node
+// for abs. A file or symlink is recomputed only when the cached (mtime,
+// size, mode) tuple no longer matches what's on disk; a directory is always
+// recomputed by recursing into its children, each of which gets the same
+// check.
+func (cc *CacheContext) resolve(abs string) (*node, error) {
+	fi, err := os.Lstat(abs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to stat %s: %w", abs, err)
+	}
+
+	key := cc.key(abs)
+
+	// Directories must always be walked: a child's content can change
+	// without touching the directory's own mtime (e.g. a file rewritten
+	// in place), so the directory's cached tuple matching is not enough to
+	// trust its cached ContentsDigest. Each child still gets the fast path
+	// below when it is itself unchanged.
+	if !fi.IsDir() {
+		if cached, ok := cc.nodes[key]; ok && cached.matches(fi) {
+			return cached, nil
+		}
+	}
+
+	n := &node{ModTime: fi.ModTime(), Size: fi.Size(), Mode: fi.Mode()}
+	n.HeaderDigest = headerDigest(filepath.Base(abs), fi)
+
+	switch {
+	case fi.IsDir():
+		entries, err := os.ReadDir(abs)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", abs, err)
+		}
+
+		h := sha256.New()
+		fmt.Fprintf(h, "dir:%s\n", n.HeaderDigest)
+		for _, entry := range entries {
+			child, err := cc.resolve(filepath.Join(abs, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(h, "%s %s %s\n", entry.Name(), child.HeaderDigest, child.ContentsDigest)
+		}
+		n.ContentsDigest = hex.EncodeToString(h.Sum(nil))
+
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(abs)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read symlink %s: %w", abs, err)
+		}
+		h := sha256.New()
+		fmt.Fprintf(h, "symlink:%s:%s\n", n.HeaderDigest, target)
+		n.ContentsDigest = hex.EncodeToString(h.Sum(nil))
+
+	default:
+		sum, elfInfo, err := scanFile(abs)
+		if err != nil {
+			return nil, err
+		}
+		n.SHA256 = sum
+		n.IsELF = elfInfo.isELF
+		n.ImportedLibraries = elfInfo.importedLibraries
+		n.Soname = elfInfo.soname
+
+		h := sha256.New()
+		fmt.Fprintf(h, "file:%s:%s\n", n.HeaderDigest, n.SHA256)
+		n.ContentsDigest = hex.EncodeToString(h.Sum(nil))
+	}
+
+	cc.nodes[key] = n
+	return n, nil
+}
+
+// key returns the cache key for abs: its path relative to cc.root.
+func (cc *CacheContext) key(abs string) string {
+	rel, err := filepath.Rel(cc.root, abs)
+	if err != nil {
+		return abs
+	}
+	return rel
+}
+
+// headerDigest digests a node's own metadata -- its basename, mode, and
+// size -- independent of its contents.
+func headerDigest(name string, fi os.FileInfo) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s:%o:%d\n", name, fi.Mode(), fi.Size())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// elfScan is the result of scanning a regular file for ELF metadata.
+type elfScan struct {
+	isELF             bool
+	importedLibraries []string
+	soname            string
+}
+
+// scanFile computes the sha256 of abs and, if it looks like an ELF object,
+// its imported libraries and soname.
+func scanFile(abs string) (string, elfScan, error) {
+	f, err := os.Open(abs)
+	if err != nil {
+		return "", elfScan{}, fmt.Errorf("unable to open %s: %w", abs, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", elfScan{}, fmt.Errorf("unable to hash %s: %w", abs, err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	ef, err := elf.Open(abs)
+	if err != nil {
+		// most likely not an ELF object (e.g. a shell script); that's fine.
+		return sum, elfScan{}, nil
+	}
+	defer ef.Close()
+
+	libs, err := ef.ImportedLibraries()
+	if err != nil {
+		return sum, elfScan{isELF: true}, nil
+	}
+
+	var soname string
+	if sonames, err := ef.DynString(elf.DT_SONAME); err == nil && len(sonames) > 0 {
+		soname = sonames[0]
+	}
+
+	return sum, elfScan{isELF: true, importedLibraries: libs, soname: soname}, nil
+}
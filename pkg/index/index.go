@@ -0,0 +1,608 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package index generates an Alpine-compatible APKINDEX.tar.gz from a
+// directory of built .apk files, so that they can be served as an apk
+// repository.
+package index
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1" // nolint:gosec
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"chainguard.dev/melange/internal/sign"
+)
+
+// Entry holds the fields of a single APKINDEX record, in the RFC822-style
+// encoding apk-tools expects.
+type Entry struct {
+	Checksum      string   // C:
+	Origin        string   // P: (pkgname)
+	Version       string   // V:
+	Arch          string   // A:
+	Size          int64    // S:
+	InstalledSize int64    // I:
+	Description   string   // T:
+	Depends       []string // D:
+	Provides      []string // p:
+	// Dirs is the per-file tree recovered from data.tar.gz, grouped by
+	// directory in the F:/M:/R:/Z: records apk-tools uses for file-conflict
+	// detection and `--who-owns`.
+	Dirs []DirEntry
+}
+
+// DirEntry is one directory's worth of F:/M:/R:/Z: records: the directory
+// itself (F:, M:) and the regular files apk-tools tracks beneath it (one
+// R:/Z: pair per file).
+type DirEntry struct {
+	Name  string // F: directory path, relative to the package root
+	Mode  int64  // M: mode:uid:gid of the directory
+	UID   int
+	GID   int
+	Files []FileEntry
+}
+
+// FileEntry is a single R:/Z: pair: a filename within its DirEntry and the
+// Q1-prefixed base64 sha1 checksum of its contents.
+type FileEntry struct {
+	Name     string // R:
+	Checksum string // Z:
+}
+
+// render writes the RFC822-style APKINDEX record for e to w, followed by a
+// blank line separating it from the next record.
+func (e *Entry) render(w io.Writer) error {
+	fmt.Fprintf(w, "C:%s\n", e.Checksum)
+	fmt.Fprintf(w, "P:%s\n", e.Origin)
+	fmt.Fprintf(w, "V:%s\n", e.Version)
+	fmt.Fprintf(w, "A:%s\n", e.Arch)
+	fmt.Fprintf(w, "S:%d\n", e.Size)
+	fmt.Fprintf(w, "I:%d\n", e.InstalledSize)
+
+	if e.Description != "" {
+		fmt.Fprintf(w, "T:%s\n", e.Description)
+	}
+
+	if len(e.Depends) > 0 {
+		fmt.Fprintf(w, "D:%s\n", strings.Join(e.Depends, " "))
+	}
+
+	if len(e.Provides) > 0 {
+		fmt.Fprintf(w, "p:%s\n", strings.Join(e.Provides, " "))
+	}
+
+	for _, dir := range e.Dirs {
+		fmt.Fprintf(w, "F:%s\n", dir.Name)
+		fmt.Fprintf(w, "M:%d:%d:%d\n", dir.Mode, dir.UID, dir.GID)
+
+		for _, file := range dir.Files {
+			fmt.Fprintf(w, "R:%s\n", file.Name)
+			fmt.Fprintf(w, "Z:%s\n", file.Checksum)
+		}
+	}
+
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// Publisher walks a directory of built .apk files and produces an
+// APKINDEX.tar.gz repository index, one per architecture found.
+type Publisher struct {
+	Logger            *log.Logger
+	OutDir            string
+	SigningKey        string
+	SigningPassphrase string
+	// Append merges newly discovered entries into an existing APKINDEX
+	// rather than rewriting it from scratch.
+	Append bool
+}
+
+// Architectures returns the set of apk architecture subdirectories present
+// under p.OutDir.
+func (p *Publisher) Architectures() ([]string, error) {
+	entries, err := os.ReadDir(p.OutDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read output directory: %w", err)
+	}
+
+	var archs []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		archs = append(archs, entry.Name())
+	}
+
+	sort.Strings(archs)
+	return archs, nil
+}
+
+// PublishAll generates an APKINDEX.tar.gz for every architecture directory
+// found under p.OutDir.
+func (p *Publisher) PublishAll() error {
+	archs, err := p.Architectures()
+	if err != nil {
+		return err
+	}
+
+	for _, arch := range archs {
+		if err := p.Publish(arch); err != nil {
+			return fmt.Errorf("unable to index %s: %w", arch, err)
+		}
+	}
+
+	return nil
+}
+
+// Publish generates APKINDEX.tar.gz for a single architecture directory.
+func (p *Publisher) Publish(arch string) error {
+	archDir := filepath.Join(p.OutDir, arch)
+
+	p.Logger.Printf("indexing %s", archDir)
+
+	entries, err := p.readExisting(archDir)
+	if err != nil {
+		return err
+	}
+
+	apks, err := filepath.Glob(filepath.Join(archDir, "*.apk"))
+	if err != nil {
+		return fmt.Errorf("unable to glob apks: %w", err)
+	}
+
+	for _, apkPath := range apks {
+		entry, err := readEntry(apkPath, arch)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %w", apkPath, err)
+		}
+
+		entries[entry.Origin+"-"+entry.Version] = entry
+	}
+
+	sorted := make([]*Entry, 0, len(entries))
+	for _, entry := range entries {
+		sorted = append(sorted, entry)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Origin < sorted[j].Origin })
+
+	var indexBuf bytes.Buffer
+	for _, entry := range sorted {
+		if err := entry.render(&indexBuf); err != nil {
+			return fmt.Errorf("unable to render index: %w", err)
+		}
+	}
+
+	return p.writeIndexArchive(archDir, indexBuf.Bytes())
+}
+
+// readExisting loads the APKINDEX records already present under archDir,
+// when Append is set. Otherwise it returns an empty set so the index is
+// rebuilt from scratch.
+func (p *Publisher) readExisting(archDir string) (map[string]*Entry, error) {
+	entries := map[string]*Entry{}
+	if !p.Append {
+		return entries, nil
+	}
+
+	f, err := os.Open(filepath.Join(archDir, "APKINDEX.tar.gz"))
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to open existing APKINDEX.tar.gz: %w", err)
+	}
+	defer f.Close()
+
+	// a signed index begins with its own signature member, so read the
+	// concatenated gzip members one at a time, as readEntry does for apks.
+	br := bufio.NewReader(f)
+	for {
+		member, err := nextGzipMember(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to read existing APKINDEX.tar.gz: %w", err)
+		}
+
+		if idx, ok := member.files["APKINDEX"]; ok {
+			for _, entry := range parseIndex(bytes.NewReader(idx.body)) {
+				entries[entry.Origin+"-"+entry.Version] = entry
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// parseIndex parses the RFC822-style records in an APKINDEX stream.
+func parseIndex(r io.Reader) []*Entry {
+	var entries []*Entry
+	cur := &Entry{}
+	var curDir *DirEntry
+
+	flushDir := func() {
+		if curDir != nil {
+			cur.Dirs = append(cur.Dirs, *curDir)
+			curDir = nil
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			flushDir()
+			if cur.Origin != "" {
+				entries = append(entries, cur)
+			}
+			cur = &Entry{}
+			continue
+		}
+
+		if len(line) < 2 || line[1] != ':' {
+			continue
+		}
+
+		value := line[2:]
+		switch line[0] {
+		case 'C':
+			cur.Checksum = value
+		case 'P':
+			cur.Origin = value
+		case 'V':
+			cur.Version = value
+		case 'A':
+			cur.Arch = value
+		case 'T':
+			cur.Description = value
+		case 'D':
+			cur.Depends = strings.Fields(value)
+		case 'p':
+			cur.Provides = strings.Fields(value)
+		case 'F':
+			flushDir()
+			curDir = &DirEntry{Name: value}
+		case 'M':
+			if curDir != nil {
+				fmt.Sscanf(value, "%d:%d:%d", &curDir.Mode, &curDir.UID, &curDir.GID)
+			}
+		case 'R':
+			if curDir != nil {
+				curDir.Files = append(curDir.Files, FileEntry{Name: value})
+			}
+		case 'Z':
+			if curDir != nil && len(curDir.Files) > 0 {
+				curDir.Files[len(curDir.Files)-1].Checksum = value
+			}
+		}
+	}
+
+	flushDir()
+	if cur.Origin != "" {
+		entries = append(entries, cur)
+	}
+
+	return entries
+}
+
+// writeIndexArchive wraps index (the raw APKINDEX contents) and a generated
+// DESCRIPTION file into APKINDEX.tar.gz, signing it when a signing key is
+// configured.
+func (p *Publisher) writeIndexArchive(archDir string, index []byte) error {
+	var unsigned bytes.Buffer
+	tw := tar.NewWriter(&unsigned)
+
+	files := map[string][]byte{
+		"APKINDEX":    index,
+		"DESCRIPTION": []byte("APKINDEX.tar.gz generated by melange\n"),
+	}
+
+	for _, name := range []string{"APKINDEX", "DESCRIPTION"} {
+		data := files[name]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+			return fmt.Errorf("unable to write %s header: %w", name, err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return fmt.Errorf("unable to write %s: %w", name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("unable to finalize index tar: %w", err)
+	}
+
+	var gzipped bytes.Buffer
+	gzw := gzip.NewWriter(&gzipped)
+	if _, err := gzw.Write(unsigned.Bytes()); err != nil {
+		return fmt.Errorf("unable to compress index: %w", err)
+	}
+	if err := gzw.Close(); err != nil {
+		return fmt.Errorf("unable to compress index: %w", err)
+	}
+
+	combined := gzipped.Bytes()
+
+	if p.SigningKey != "" {
+		digest := sha1.Sum(gzipped.Bytes()) // nolint:gosec
+		sigBuf, err := sign.RSASignSHA1Digest(digest[:], p.SigningKey, p.SigningPassphrase)
+		if err != nil {
+			return fmt.Errorf("unable to sign index: %w", err)
+		}
+
+		var sigTar bytes.Buffer
+		stw := tar.NewWriter(&sigTar)
+		sigName := fmt.Sprintf(".SIGN.RSA.%s.pub", filepath.Base(p.SigningKey))
+		if err := stw.WriteHeader(&tar.Header{Name: sigName, Mode: 0644, Size: int64(len(sigBuf))}); err != nil {
+			return fmt.Errorf("unable to write signature header: %w", err)
+		}
+		if _, err := stw.Write(sigBuf); err != nil {
+			return fmt.Errorf("unable to write signature: %w", err)
+		}
+		if err := stw.Close(); err != nil {
+			return fmt.Errorf("unable to finalize signature tar: %w", err)
+		}
+
+		var sigGz bytes.Buffer
+		sgzw := gzip.NewWriter(&sigGz)
+		if _, err := sgzw.Write(sigTar.Bytes()); err != nil {
+			return fmt.Errorf("unable to compress signature: %w", err)
+		}
+		if err := sgzw.Close(); err != nil {
+			return fmt.Errorf("unable to compress signature: %w", err)
+		}
+
+		combined = append(sigGz.Bytes(), combined...)
+	}
+
+	outPath := filepath.Join(archDir, "APKINDEX.tar.gz")
+	if err := os.WriteFile(outPath, combined, 0644); err != nil {
+		return fmt.Errorf("unable to write %s: %w", outPath, err)
+	}
+
+	p.Logger.Printf("wrote %s", outPath)
+	return nil
+}
+
+// readEntry extracts an Entry from a built .apk file's control and data
+// tarballs.
+func readEntry(apkPath, arch string) (*Entry, error) {
+	f, err := os.Open(apkPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// apk members are concatenated gzip streams; read them off a single
+	// shared bufio.Reader so each gzip.NewReader call picks up exactly
+	// where the previous one left off.
+	br := bufio.NewReader(f)
+
+	member, err := nextGzipMember(br)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read signature/control member: %w", err)
+	}
+
+	// an apk may optionally begin with a detached signature tarball; if
+	// this member isn't the control tarball, read the next one.
+	if _, ok := member.files[".PKGINFO"]; !ok {
+		member, err = nextGzipMember(br)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read control member: %w", err)
+		}
+	}
+
+	pkginfo, ok := member.files[".PKGINFO"]
+	if !ok {
+		return nil, fmt.Errorf("%s: missing .PKGINFO", apkPath)
+	}
+
+	entry := parsePkginfo(pkginfo.body)
+	entry.Arch = arch
+	entry.Size = fi.Size()
+	entry.Checksum = "Q1" + base64.StdEncoding.EncodeToString(member.sha1[:])
+
+	data, err := nextGzipMember(br)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read data member: %w", err)
+	}
+	entry.Dirs = fileTree(data)
+
+	return entry, nil
+}
+
+// fileTree groups a data tarball's regular files by directory into the
+// F:/M:/R:/Z: records apk-tools expects, in the order directories were
+// first seen in the tarball.
+func fileTree(data *gzipMember) []DirEntry {
+	index := map[string]int{}
+	var dirs []DirEntry
+
+	for _, name := range data.order {
+		entry := data.files[name]
+		if !entry.hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		dir := path.Dir(strings.TrimPrefix(name, "./"))
+		i, ok := index[dir]
+		if !ok {
+			i = len(dirs)
+			index[dir] = i
+			dirs = append(dirs, newDirEntry(data, dir))
+		}
+
+		sum := sha1.Sum(entry.body) // nolint:gosec
+		dirs[i].Files = append(dirs[i].Files, FileEntry{
+			Name:     path.Base(name),
+			Checksum: "Q1" + base64.StdEncoding.EncodeToString(sum[:]),
+		})
+	}
+
+	return dirs
+}
+
+// newDirEntry builds a DirEntry's M: fields from dir's own tar header --
+// tar directory entries are conventionally named with a trailing slash, and
+// may or may not carry a "./" prefix depending on how the archive was built
+// -- falling back to a plain 0755 root:root directory if the tarball never
+// wrote an explicit header for it.
+func newDirEntry(data *gzipMember, dir string) DirEntry {
+	rec := DirEntry{Name: dir, Mode: 0755}
+
+	for _, candidate := range []string{dir + "/", "./" + dir + "/", dir} {
+		if hdr, ok := data.files[candidate]; ok {
+			rec.Mode = hdr.hdr.Mode
+			rec.UID = hdr.hdr.Uid
+			rec.GID = hdr.hdr.Gid
+			break
+		}
+	}
+
+	return rec
+}
+
+// parsePkginfo decodes the `key = value` lines of a .PKGINFO file into an
+// Entry.
+func parsePkginfo(data []byte) *Entry {
+	entry := &Entry{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		switch key {
+		case "pkgname":
+			entry.Origin = value
+		case "pkgver":
+			entry.Version = value
+		case "pkgdesc":
+			entry.Description = value
+		case "size":
+			fmt.Sscanf(value, "%d", &entry.InstalledSize)
+		case "depend":
+			entry.Depends = append(entry.Depends, value)
+		case "provides":
+			entry.Provides = append(entry.Provides, value)
+		}
+	}
+
+	return entry
+}
+
+// tarEntry is a single decoded tar entry: its header plus body.
+type tarEntry struct {
+	hdr  *tar.Header
+	body []byte
+}
+
+// gzipMember is the decoded contents and raw sha1 digest of a single
+// concatenated gzip member inside an apk file.
+type gzipMember struct {
+	files map[string]tarEntry
+	order []string // file names, in the order they appeared in the tarball
+	sha1  [20]byte
+}
+
+// teeByteReader wraps a *bufio.Reader, copying every byte read through it
+// into tee, while still satisfying the io.Reader+io.ByteReader pair
+// (flate.Reader) that gzip.NewReader looks for. Passing a plain
+// io.TeeReader instead would make gzip fall back to wrapping the input in
+// its own internal bufio.Reader, which reads ahead and leaves the shared
+// *bufio.Reader positioned past the end of this member -- corrupting the
+// next nextGzipMember call's read of the following concatenated member.
+type teeByteReader struct {
+	r   *bufio.Reader
+	tee io.Writer
+}
+
+func (t *teeByteReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.tee.Write(p[:n])
+	}
+	return n, err
+}
+
+func (t *teeByteReader) ReadByte() (byte, error) {
+	b, err := t.r.ReadByte()
+	if err == nil {
+		t.tee.Write([]byte{b})
+	}
+	return b, err
+}
+
+// nextGzipMember reads the next gzip-compressed tar member off br, starting
+// at its current position, and returns its file contents along with the
+// sha1 digest of its raw (still-compressed) bytes. Successive calls with
+// the same br correctly continue from the end of the previous member.
+func nextGzipMember(br *bufio.Reader) (*gzipMember, error) {
+	digest := sha1.New() // nolint:gosec
+	tbr := &teeByteReader{r: br, tee: digest}
+
+	gzr, err := gzip.NewReader(tbr)
+	if err != nil {
+		return nil, err
+	}
+	gzr.Multistream(false)
+	defer gzr.Close()
+
+	files := map[string]tarEntry{}
+	var order []string
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, tr); err != nil {
+			return nil, err
+		}
+		files[hdr.Name] = tarEntry{hdr: hdr, body: buf.Bytes()}
+		order = append(order, hdr.Name)
+	}
+
+	var sum [20]byte
+	copy(sum[:], digest.Sum(nil))
+
+	return &gzipMember{files: files, order: order, sha1: sum}, nil
+}
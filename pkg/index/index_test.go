@@ -0,0 +1,186 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeGzipMember appends a new gzip-compressed tar member containing files
+// to buf, mimicking how melange concatenates sig|control|data members.
+func writeGzipMember(t *testing.T, buf *bytes.Buffer, files map[string]string) {
+	t.Helper()
+
+	gzw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gzw)
+
+	for name, body := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body))}); err != nil {
+			t.Fatalf("unable to write %s header: %v", name, err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatalf("unable to write %s: %v", name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unable to finalize tar: %v", err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatalf("unable to finalize gzip: %v", err)
+	}
+}
+
+// writeDataMember appends a gzip-compressed tar member built from explicit
+// headers, so callers can include a directory entry with its own mode/uid/gid
+// -- unlike writeGzipMember, which only ever writes regular files at a fixed
+// mode.
+func writeDataMember(t *testing.T, buf *bytes.Buffer, entries []tar.Header, bodies map[string]string) {
+	t.Helper()
+
+	gzw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gzw)
+
+	for _, hdr := range entries {
+		body := bodies[hdr.Name]
+		hdr.Size = int64(len(body))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("unable to write %s header: %v", hdr.Name, err)
+		}
+		if body != "" {
+			if _, err := tw.Write([]byte(body)); err != nil {
+				t.Fatalf("unable to write %s: %v", hdr.Name, err)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unable to finalize tar: %v", err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatalf("unable to finalize gzip: %v", err)
+	}
+}
+
+// TestPublishRoundTrip builds a small fake apk -- small enough that a naive
+// reader which re-wraps the raw file in a fresh bufio.Reader for each
+// concatenated gzip member would read ahead into the next member and lose
+// its place -- indexes it, and checks the resulting APKINDEX.tar.gz.
+func TestPublishRoundTrip(t *testing.T) {
+	var apk bytes.Buffer
+
+	writeGzipMember(t, &apk, map[string]string{
+		".PKGINFO": "pkgname = foo\npkgver = 1.0-r0\npkgdesc = a test package\ndepend = bar\nprovides = cmd:foo=1.0-r0\n",
+	})
+	writeDataMember(t, &apk, []tar.Header{
+		// usr/bin is 0750, the file inside it 0644 -- deliberately distinct
+		// modes, so a fileTree that mistakenly copies a contained file's
+		// header for its directory's M: record shows up as a failure here.
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0750, Uid: 100, Gid: 100},
+		{Name: "usr/bin/foo", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{
+		"usr/bin/foo": "#!/bin/sh\necho foo\n",
+	})
+
+	archDir := filepath.Join(t.TempDir(), "x86_64")
+	if err := os.MkdirAll(archDir, 0755); err != nil {
+		t.Fatalf("unable to create arch dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(archDir, "foo-1.0-r0.apk"), apk.Bytes(), 0644); err != nil {
+		t.Fatalf("unable to write test apk: %v", err)
+	}
+
+	pub := &Publisher{
+		Logger: log.New(io.Discard, "", 0),
+		OutDir: filepath.Dir(archDir),
+	}
+
+	if err := pub.Publish("x86_64"); err != nil {
+		t.Fatalf("Publish() = %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(archDir, "APKINDEX.tar.gz"))
+	if err != nil {
+		t.Fatalf("unable to open APKINDEX.tar.gz: %v", err)
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip.NewReader() = %v", err)
+	}
+	defer gzr.Close()
+
+	var index []byte
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar.Next() = %v", err)
+		}
+		if hdr.Name != "APKINDEX" {
+			continue
+		}
+		if index, err = io.ReadAll(tr); err != nil {
+			t.Fatalf("unable to read APKINDEX: %v", err)
+		}
+	}
+
+	entries := parseIndex(bytes.NewReader(index))
+	if len(entries) != 1 {
+		t.Fatalf("len(entries) = %d, want 1 (index:\n%s)", len(entries), index)
+	}
+
+	entry := entries[0]
+	if entry.Origin != "foo" || entry.Version != "1.0-r0" {
+		t.Errorf("entry = %+v, want pkgname foo version 1.0-r0", entry)
+	}
+	if len(entry.Depends) != 1 || entry.Depends[0] != "bar" {
+		t.Errorf("Depends = %v, want [bar]", entry.Depends)
+	}
+
+	var dir *DirEntry
+	for i := range entry.Dirs {
+		if entry.Dirs[i].Name == "usr/bin" {
+			dir = &entry.Dirs[i]
+		}
+	}
+	if dir == nil {
+		t.Fatalf("expected usr/bin directory entry, got %+v", entry.Dirs)
+	}
+	if dir.Mode != 0750 || dir.UID != 100 || dir.GID != 100 {
+		t.Errorf("usr/bin M: = mode %o uid %d gid %d, want mode 0750 uid 100 gid 100 (not the 0644 file's own header)", dir.Mode, dir.UID, dir.GID)
+	}
+
+	var found bool
+	for _, file := range dir.Files {
+		if file.Name == "foo" && file.Checksum != "" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected usr/bin/foo in file tree, got %+v", dir.Files)
+	}
+}